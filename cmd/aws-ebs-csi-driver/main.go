@@ -0,0 +1,50 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command aws-ebs-csi-driver runs the identity, controller and node CSI
+// services from a single process. It is kept for backward compatibility with
+// deployments that have not yet split onto the dedicated
+// aws-ebs-csi-controller and aws-ebs-csi-node binaries; --mode selects which
+// services are actually served.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/driver"
+)
+
+func main() {
+	var (
+		endpoint = flag.String("endpoint", "unix:///var/lib/csi/sockets/pluginproxy/csi.sock", "CSI endpoint")
+		region   = flag.String("aws-region", "", "AWS region to use; it is not looked up from EC2 instance metadata")
+		mode     = flag.String("mode", string(driver.AllMode), "driver mode: controller, node or all")
+	)
+	flag.Parse()
+
+	d, err := driver.NewDriver(*endpoint, *region, driver.Mode(*mode))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create driver: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := d.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "driver exited with error: %v\n", err)
+		os.Exit(1)
+	}
+}
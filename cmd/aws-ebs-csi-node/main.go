@@ -0,0 +1,44 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command aws-ebs-csi-node runs only the identity and node CSI services. It
+// is the image used by the node DaemonSet, which needs mount tooling but no
+// AWS credentials.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/driver"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "unix:///var/lib/csi/sockets/pluginproxy/csi.sock", "CSI endpoint")
+	flag.Parse()
+
+	d, err := driver.NewDriver(*endpoint, "", driver.NodeMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create driver: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := d.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "driver exited with error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,698 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/util"
+)
+
+const (
+	// DefaultVolumeSize is the default size, in bytes, of a volume created
+	// when no capacity range is given.
+	DefaultVolumeSize = 1 * util.GiB
+
+	// VolumeNameTagKey is the key value that refers to the volume's name.
+	VolumeNameTagKey = "CSIVolumeName"
+	// SnapshotNameTagKey is the key value that refers to the snapshot's name.
+	SnapshotNameTagKey = "CSIVolumeSnapshotName"
+
+	// VolumeTypeIO1 represents an io1 volume.
+	VolumeTypeIO1 = "io1"
+	// VolumeTypeIO2 represents an io2 volume.
+	VolumeTypeIO2 = "io2"
+	// VolumeTypeGP2 represents a gp2 volume.
+	VolumeTypeGP2 = "gp2"
+	// VolumeTypeGP3 represents a gp3 volume.
+	VolumeTypeGP3 = "gp3"
+
+	defaultVolumeType = VolumeTypeGP2
+)
+
+var (
+	// ErrMultiDisks is an error that is returned when multiple disks are found with the same volume name.
+	ErrMultiDisks = errors.New("Multiple disks with same name")
+	// ErrDiskExistsDiffSize is an error that is returned if a disk with a given name, but different size, is found.
+	ErrDiskExistsDiffSize = errors.New("There is already a disk with same name and different size")
+	// ErrNotFound is returned when a resource is not found.
+	ErrNotFound = errors.New("Resource was not found")
+	// ErrAlreadyExists is returned when a resource is already attached to a different resource.
+	ErrAlreadyExists = errors.New("Resource already exists")
+	// ErrInvalidArgument is returned when a request to AWS was rejected because of a bad argument.
+	ErrInvalidArgument = errors.New("Invalid argument")
+	// ErrModificationCooldown is returned when a volume modification is requested before
+	// the AWS cooldown period (6 hours) since the last modification has elapsed.
+	ErrModificationCooldown = errors.New("Volume is still within its modification cooldown period")
+)
+
+// modificationCooldown is the minimum amount of time AWS requires between two
+// ModifyVolume calls on the same volume.
+const modificationCooldown = 6 * time.Hour
+
+// Disk represents an EBS volume.
+type Disk struct {
+	VolumeID         string
+	CapacityGiB      int64
+	AvailabilityZone string
+	SnapshotID       string
+	FsType           string
+}
+
+// DiskOptions represents parameters to create an EBS volume.
+type DiskOptions struct {
+	CapacityBytes    int64
+	Tags             map[string]string
+	VolumeType       string
+	IOPSPerGB        int
+	IOPS             int64
+	Throughput       int64
+	AvailabilityZone string
+	Encrypted        bool
+	KmsKeyID         string
+	SnapshotID       string
+}
+
+// Snapshot represents an EBS volume snapshot.
+type Snapshot struct {
+	SnapshotID     string
+	SourceVolumeID string
+	Size           int64
+	CreationTime   time.Time
+	ReadyToUse     bool
+}
+
+// SnapshotOptions represents parameters to create an EBS volume snapshot.
+type SnapshotOptions struct {
+	Tags map[string]string
+}
+
+// Provider is the set of cloud operations the driver needs. It is
+// implemented by *Cloud against the real EC2 API, and by cloud/fake's
+// in-memory implementation for driver-level tests that would otherwise need
+// a heavy EC2 mock for every scenario.
+type Provider interface {
+	GetDiskByName(ctx context.Context, name string, capacityBytes int64) (*Disk, error)
+	GetDiskByID(ctx context.Context, volumeID string) (*Disk, error)
+	CreateDisk(ctx context.Context, volumeName string, diskOptions *DiskOptions) (*Disk, error)
+	DeleteDisk(ctx context.Context, volumeID string) (bool, error)
+	AttachDisk(ctx context.Context, volumeID, nodeID string) (string, error)
+	DetachDisk(ctx context.Context, volumeID, nodeID string) error
+	IsExistInstance(ctx context.Context, nodeID string) bool
+	ResizeDisk(ctx context.Context, volumeID string, newSizeBytes int64) (int64, error)
+	ListDisks(ctx context.Context, maxEntries int, startingToken string) ([]*Disk, string, error)
+	CreateSnapshot(ctx context.Context, volumeID string, snapshotOptions *SnapshotOptions) (*Snapshot, error)
+	DeleteSnapshot(ctx context.Context, snapshotID string) (bool, error)
+	GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error)
+	GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error)
+	ListSnapshots(ctx context.Context, sourceVolumeID string, maxEntries int, startingToken string) ([]*Snapshot, string, error)
+	AvailabilityZones(ctx context.Context) ([]string, error)
+}
+
+// Cloud is the AWS-backed implementation of the driver's EC2 access.
+type Cloud struct {
+	region string
+	ec2    ec2iface.EC2API
+}
+
+var _ Provider = &Cloud{}
+
+// NewCloud returns a new Cloud backed by a real EC2 client for the given region.
+func NewCloud(region string) (*Cloud, error) {
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(region)))
+	return &Cloud{
+		region: region,
+		ec2:    ec2.New(sess),
+	}, nil
+}
+
+// GetDiskByName returns a disk matching the given name, validating it has the
+// requested capacity. Returns ErrNotFound if no disk exists.
+func (c *Cloud) GetDiskByName(ctx context.Context, name string, capacityBytes int64) (*Disk, error) {
+	request := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + VolumeNameTagKey),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	}
+
+	volumes, err := c.describeVolumes(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, ErrNotFound
+	}
+	if len(volumes) > 1 {
+		return nil, ErrMultiDisks
+	}
+
+	vol := volumes[0]
+	if aws.Int64Value(vol.Size)*util.GiB != capacityBytes {
+		return nil, ErrDiskExistsDiffSize
+	}
+
+	return &Disk{
+		VolumeID:         aws.StringValue(vol.VolumeId),
+		CapacityGiB:      aws.Int64Value(vol.Size),
+		AvailabilityZone: aws.StringValue(vol.AvailabilityZone),
+		SnapshotID:       aws.StringValue(vol.SnapshotId),
+	}, nil
+}
+
+// GetDiskByID returns a disk matching the given EBS volume ID.
+func (c *Cloud) GetDiskByID(ctx context.Context, volumeID string) (*Disk, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+
+	volumes, err := c.describeVolumes(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, ErrNotFound
+	}
+	if len(volumes) > 1 {
+		return nil, ErrMultiDisks
+	}
+
+	vol := volumes[0]
+	return &Disk{
+		VolumeID:         aws.StringValue(vol.VolumeId),
+		CapacityGiB:      aws.Int64Value(vol.Size),
+		AvailabilityZone: aws.StringValue(vol.AvailabilityZone),
+		SnapshotID:       aws.StringValue(vol.SnapshotId),
+	}, nil
+}
+
+// CreateDisk creates a new EBS volume with the given options.
+func (c *Cloud) CreateDisk(ctx context.Context, volumeName string, diskOptions *DiskOptions) (*Disk, error) {
+	volumeType := diskOptions.VolumeType
+	if len(volumeType) == 0 {
+		volumeType = defaultVolumeType
+	}
+
+	var iops int64
+	switch volumeType {
+	case VolumeTypeIO1:
+		iops = int64(diskOptions.IOPSPerGB) * util.RoundUpGiB(diskOptions.CapacityBytes)
+	case VolumeTypeGP3, VolumeTypeIO2:
+		iops = diskOptions.IOPS
+	}
+
+	request := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(diskOptions.AvailabilityZone),
+		Size:             aws.Int64(util.RoundUpGiB(diskOptions.CapacityBytes)),
+		VolumeType:       aws.String(volumeType),
+		Encrypted:        aws.Bool(diskOptions.Encrypted),
+	}
+	if iops > 0 {
+		request.Iops = aws.Int64(iops)
+	}
+	if volumeType == VolumeTypeGP3 && diskOptions.Throughput > 0 {
+		request.Throughput = aws.Int64(diskOptions.Throughput)
+	}
+	if len(diskOptions.KmsKeyID) > 0 {
+		request.KmsKeyId = aws.String(diskOptions.KmsKeyID)
+	}
+	if len(diskOptions.SnapshotID) > 0 {
+		request.SnapshotId = aws.String(diskOptions.SnapshotID)
+	}
+
+	tags := make([]*ec2.Tag, 0, len(diskOptions.Tags))
+	for key, value := range diskOptions.Tags {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	if len(tags) > 0 {
+		request.TagSpecifications = []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String("volume"),
+				Tags:         tags,
+			},
+		}
+	}
+
+	response, err := c.ec2.CreateVolumeWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("could not create volume in EC2: %v", err)
+	}
+
+	return &Disk{
+		VolumeID:         aws.StringValue(response.VolumeId),
+		CapacityGiB:      aws.Int64Value(response.Size),
+		AvailabilityZone: aws.StringValue(response.AvailabilityZone),
+		SnapshotID:       diskOptions.SnapshotID,
+	}, nil
+}
+
+// DeleteDisk deletes the EBS volume with the given volume ID.
+func (c *Cloud) DeleteDisk(ctx context.Context, volumeID string) (bool, error) {
+	request := &ec2.DeleteVolumeInput{VolumeId: aws.String(volumeID)}
+	if _, err := c.ec2.DeleteVolumeWithContext(ctx, request); err != nil {
+		if isAWSErrorVolumeNotFound(err) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("could not delete volume %q: %v", volumeID, err)
+	}
+	return true, nil
+}
+
+// AttachDisk attaches the given EBS volume to the given EC2 instance and
+// returns the device path the volume was attached at.
+func (c *Cloud) AttachDisk(ctx context.Context, volumeID, nodeID string) (string, error) {
+	instance, err := c.getInstance(ctx, nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	device, err := c.findFreeDevice(instance)
+	if err != nil {
+		return "", err
+	}
+
+	request := &ec2.AttachVolumeInput{
+		Device:     aws.String(device),
+		InstanceId: aws.String(nodeID),
+		VolumeId:   aws.String(volumeID),
+	}
+	if _, err := c.ec2.AttachVolumeWithContext(ctx, request); err != nil {
+		if isAWSErrorVolumeInUse(err) {
+			return "", ErrAlreadyExists
+		}
+		return "", fmt.Errorf("could not attach volume %q to node %q: %v", volumeID, nodeID, err)
+	}
+
+	if err := c.waitForAttachmentState(ctx, volumeID, "attached"); err != nil {
+		return "", err
+	}
+
+	return device, nil
+}
+
+// DetachDisk detaches the given EBS volume from the given EC2 instance.
+func (c *Cloud) DetachDisk(ctx context.Context, volumeID, nodeID string) error {
+	request := &ec2.DetachVolumeInput{
+		InstanceId: aws.String(nodeID),
+		VolumeId:   aws.String(volumeID),
+	}
+	if _, err := c.ec2.DetachVolumeWithContext(ctx, request); err != nil {
+		return fmt.Errorf("could not detach volume %q from node %q: %v", volumeID, nodeID, err)
+	}
+	return c.waitForAttachmentState(ctx, volumeID, "detached")
+}
+
+// IsExistInstance returns true if the given node ID maps to a running EC2 instance.
+func (c *Cloud) IsExistInstance(ctx context.Context, nodeID string) bool {
+	_, err := c.getInstance(ctx, nodeID)
+	return err == nil
+}
+
+// CreateSnapshot creates a new EBS snapshot of the given source volume.
+func (c *Cloud) CreateSnapshot(ctx context.Context, volumeID string, snapshotOptions *SnapshotOptions) (*Snapshot, error) {
+	tags := make([]*ec2.Tag, 0, len(snapshotOptions.Tags))
+	for key, value := range snapshotOptions.Tags {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	request := &ec2.CreateSnapshotInput{
+		VolumeId: aws.String(volumeID),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String("snapshot"),
+				Tags:         tags,
+			},
+		},
+	}
+
+	response, err := c.ec2.CreateSnapshotWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("could not create snapshot of volume %q: %v", volumeID, err)
+	}
+
+	return newSnapshotFromEC2(response), nil
+}
+
+// DeleteSnapshot deletes the EBS snapshot with the given ID.
+func (c *Cloud) DeleteSnapshot(ctx context.Context, snapshotID string) (bool, error) {
+	request := &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotID)}
+	if _, err := c.ec2.DeleteSnapshotWithContext(ctx, request); err != nil {
+		if isAWSErrorSnapshotNotFound(err) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("could not delete snapshot %q: %v", snapshotID, err)
+	}
+	return true, nil
+}
+
+// GetSnapshotByName returns the snapshot tagged with the given name.
+func (c *Cloud) GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error) {
+	request := &ec2.DescribeSnapshotsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + SnapshotNameTagKey),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	}
+
+	response, err := c.ec2.DescribeSnapshotsWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %v", err)
+	}
+	if len(response.Snapshots) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return newSnapshotFromEC2(response.Snapshots[0]), nil
+}
+
+// GetSnapshotByID returns the snapshot with the given EBS snapshot ID.
+func (c *Cloud) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error) {
+	request := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotID)},
+	}
+
+	response, err := c.ec2.DescribeSnapshotsWithContext(ctx, request)
+	if err != nil {
+		if isAWSErrorSnapshotNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error describing snapshot %q: %v", snapshotID, err)
+	}
+	if len(response.Snapshots) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return newSnapshotFromEC2(response.Snapshots[0]), nil
+}
+
+func newSnapshotFromEC2(snapshot *ec2.Snapshot) *Snapshot {
+	return &Snapshot{
+		SnapshotID:     aws.StringValue(snapshot.SnapshotId),
+		SourceVolumeID: aws.StringValue(snapshot.VolumeId),
+		Size:           aws.Int64Value(snapshot.VolumeSize) * util.GiB,
+		CreationTime:   aws.TimeValue(snapshot.StartTime),
+		ReadyToUse:     aws.StringValue(snapshot.State) == ec2.SnapshotStateCompleted,
+	}
+}
+
+// ResizeDisk calls EC2 ModifyVolume to grow the given volume to newSizeBytes
+// and waits for the modification to reach the "optimizing" or "completed"
+// state. It returns the new size of the volume, in GiB. If the volume is
+// already the requested size, ResizeDisk is a no-op. AWS rejects a second
+// modification within modificationCooldown of the previous one completing;
+// that case is surfaced as ErrModificationCooldown.
+func (c *Cloud) ResizeDisk(ctx context.Context, volumeID string, newSizeBytes int64) (int64, error) {
+	newSizeGiB := util.RoundUpGiB(newSizeBytes)
+
+	volume, err := c.getEC2Volume(ctx, volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if aws.Int64Value(volume.Size) == newSizeGiB {
+		return newSizeGiB, nil
+	}
+	if aws.Int64Value(volume.Size) > newSizeGiB {
+		return 0, ErrInvalidArgument
+	}
+
+	modification, err := c.getLatestVolumeModification(ctx, volumeID)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	if modification != nil {
+		state := aws.StringValue(modification.ModificationState)
+		if state != ec2.VolumeModificationStateCompleted && state != "" {
+			// a modification is still in flight; AWS will reject a new one.
+			return 0, ErrModificationCooldown
+		}
+		if finishTime := aws.TimeValue(modification.EndTime); !finishTime.IsZero() && time.Since(finishTime) < modificationCooldown {
+			return 0, ErrModificationCooldown
+		}
+	}
+
+	request := &ec2.ModifyVolumeInput{
+		VolumeId: aws.String(volumeID),
+		Size:     aws.Int64(newSizeGiB),
+	}
+	if _, err := c.ec2.ModifyVolumeWithContext(ctx, request); err != nil {
+		if isAWSErrorVolumeNotFound(err) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("could not modify volume %q: %v", volumeID, err)
+	}
+
+	if err := c.waitForVolumeModification(ctx, volumeID); err != nil {
+		return 0, err
+	}
+
+	return newSizeGiB, nil
+}
+
+func (c *Cloud) getEC2Volume(ctx context.Context, volumeID string) (*ec2.Volume, error) {
+	volumes, err := c.describeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String(volumeID)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, ErrNotFound
+	}
+	return volumes[0], nil
+}
+
+func (c *Cloud) getLatestVolumeModification(ctx context.Context, volumeID string) (*ec2.VolumeModification, error) {
+	request := &ec2.DescribeVolumesModificationsInput{VolumeIds: []*string{aws.String(volumeID)}}
+	response, err := c.ec2.DescribeVolumesModificationsWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error describing volume modifications for %q: %v", volumeID, err)
+	}
+	if len(response.VolumesModifications) == 0 {
+		return nil, ErrNotFound
+	}
+	return response.VolumesModifications[0], nil
+}
+
+// waitForVolumeModification polls until the most recent modification of
+// volumeID reaches the "optimizing" or "completed" state.
+func (c *Cloud) waitForVolumeModification(ctx context.Context, volumeID string) error {
+	request := &ec2.DescribeVolumesModificationsInput{VolumeIds: []*string{aws.String(volumeID)}}
+	for i := 0; i < 60; i++ {
+		response, err := c.ec2.DescribeVolumesModificationsWithContext(ctx, request)
+		if err != nil {
+			return fmt.Errorf("error describing volume modifications for %q: %v", volumeID, err)
+		}
+		if len(response.VolumesModifications) > 0 {
+			state := aws.StringValue(response.VolumesModifications[0].ModificationState)
+			if state == ec2.VolumeModificationStateOptimizing || state == ec2.VolumeModificationStateCompleted {
+				return nil
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for volume %q modification to complete", volumeID)
+}
+
+// ListDisks returns up to maxEntries disks, resuming from startingToken if
+// set, translating CSI-style paging into EC2's NextToken/MaxResults.
+func (c *Cloud) ListDisks(ctx context.Context, maxEntries int, startingToken string) ([]*Disk, string, error) {
+	request := &ec2.DescribeVolumesInput{}
+	if maxEntries > 0 {
+		request.MaxResults = aws.Int64(int64(maxEntries))
+	}
+	if len(startingToken) > 0 {
+		request.NextToken = aws.String(startingToken)
+	}
+
+	response, err := c.ec2.DescribeVolumesWithContext(ctx, request)
+	if err != nil {
+		if isAWSErrorInvalidNextToken(err) {
+			return nil, "", ErrInvalidArgument
+		}
+		return nil, "", fmt.Errorf("error listing volumes: %v", err)
+	}
+
+	disks := make([]*Disk, 0, len(response.Volumes))
+	for _, vol := range response.Volumes {
+		disks = append(disks, &Disk{
+			VolumeID:         aws.StringValue(vol.VolumeId),
+			CapacityGiB:      aws.Int64Value(vol.Size),
+			AvailabilityZone: aws.StringValue(vol.AvailabilityZone),
+			SnapshotID:       aws.StringValue(vol.SnapshotId),
+		})
+	}
+
+	return disks, aws.StringValue(response.NextToken), nil
+}
+
+// ListSnapshots returns up to maxEntries snapshots, optionally filtered by
+// source volume ID, resuming from startingToken if set.
+func (c *Cloud) ListSnapshots(ctx context.Context, sourceVolumeID string, maxEntries int, startingToken string) ([]*Snapshot, string, error) {
+	request := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+	}
+	if len(sourceVolumeID) > 0 {
+		request.Filters = []*ec2.Filter{
+			{
+				Name:   aws.String("volume-id"),
+				Values: []*string{aws.String(sourceVolumeID)},
+			},
+		}
+	}
+	if maxEntries > 0 {
+		request.MaxResults = aws.Int64(int64(maxEntries))
+	}
+	if len(startingToken) > 0 {
+		request.NextToken = aws.String(startingToken)
+	}
+
+	response, err := c.ec2.DescribeSnapshotsWithContext(ctx, request)
+	if err != nil {
+		if isAWSErrorInvalidNextToken(err) {
+			return nil, "", ErrInvalidArgument
+		}
+		return nil, "", fmt.Errorf("error listing snapshots: %v", err)
+	}
+
+	snapshots := make([]*Snapshot, 0, len(response.Snapshots))
+	for _, snapshot := range response.Snapshots {
+		snapshots = append(snapshots, newSnapshotFromEC2(snapshot))
+	}
+
+	return snapshots, aws.StringValue(response.NextToken), nil
+}
+
+func isAWSErrorInvalidNextToken(err error) bool {
+	return containsCode(err, "InvalidNextToken")
+}
+
+// AvailabilityZones returns the names of the availability zones in c's
+// region, for callers that need to pick one without a caller-supplied
+// topology requirement (e.g. restoring a volume from a snapshot, which is
+// regional rather than zonal).
+func (c *Cloud) AvailabilityZones(ctx context.Context) ([]string, error) {
+	request := &ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("region-name"),
+				Values: []*string{aws.String(c.region)},
+			},
+			{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String(ec2.AvailabilityZoneStateAvailable)},
+			},
+		},
+	}
+
+	response, err := c.ec2.DescribeAvailabilityZonesWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error listing availability zones in region %q: %v", c.region, err)
+	}
+
+	zones := make([]string, 0, len(response.AvailabilityZones))
+	for _, zone := range response.AvailabilityZones {
+		zones = append(zones, aws.StringValue(zone.ZoneName))
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no availability zones found in region %q", c.region)
+	}
+	return zones, nil
+}
+
+func (c *Cloud) describeVolumes(ctx context.Context, request *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
+	response, err := c.ec2.DescribeVolumesWithContext(ctx, request)
+	if err != nil {
+		if isAWSErrorVolumeNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error describing volumes: %v", err)
+	}
+	return response.Volumes, nil
+}
+
+func (c *Cloud) getInstance(ctx context.Context, nodeID string) (*ec2.Instance, error) {
+	request := &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(nodeID)}}
+	response, err := c.ec2.DescribeInstancesWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error describing instance %q: %v", nodeID, err)
+	}
+	if len(response.Reservations) == 0 || len(response.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("instance %q not found", nodeID)
+	}
+	return response.Reservations[0].Instances[0], nil
+}
+
+func (c *Cloud) findFreeDevice(instance *ec2.Instance) (string, error) {
+	used := map[string]bool{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		used[aws.StringValue(mapping.DeviceName)] = true
+	}
+	for _, letter := range "fghijklmnop" {
+		device := fmt.Sprintf("/dev/sd%c", letter)
+		if !used[device] {
+			return device, nil
+		}
+	}
+	return "", errors.New("could not find a free device on instance")
+}
+
+func (c *Cloud) waitForAttachmentState(ctx context.Context, volumeID, state string) error {
+	request := &ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String(volumeID)}}
+	for i := 0; i < 40; i++ {
+		volumes, err := c.describeVolumes(ctx, request)
+		if err != nil {
+			return err
+		}
+		if len(volumes) == 1 && len(volumes[0].Attachments) > 0 && aws.StringValue(volumes[0].Attachments[0].State) == state {
+			return nil
+		}
+		if len(volumes) == 1 && len(volumes[0].Attachments) == 0 && state == "detached" {
+			return nil
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for volume %q to reach attachment state %q", volumeID, state)
+}
+
+func isAWSErrorVolumeNotFound(err error) bool {
+	return containsCode(err, "InvalidVolume.NotFound")
+}
+
+func isAWSErrorVolumeInUse(err error) bool {
+	return containsCode(err, "VolumeInUse")
+}
+
+func isAWSErrorSnapshotNotFound(err error) bool {
+	return containsCode(err, "InvalidSnapshot.NotFound")
+}
+
+func containsCode(err error, code string) bool {
+	if aerr, ok := err.(interface{ Code() string }); ok {
+		return aerr.Code() == code
+	}
+	return false
+}
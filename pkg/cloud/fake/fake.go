@@ -0,0 +1,360 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides a thread-safe, in-memory implementation of
+// cloud.Provider so driver-level tests can exercise real controller code
+// without talking to EC2.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/cloud"
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/util"
+)
+
+const defaultZone = "fake-az-1a"
+
+type fakeDisk struct {
+	cloud.Disk
+	tags       map[string]string
+	attachedTo string
+	// inModificationCooldown mirrors a real EBS volume that was modified
+	// less than modificationCooldown ago: the next ResizeDisk call must
+	// fail with cloud.ErrModificationCooldown instead of resizing.
+	inModificationCooldown bool
+}
+
+type fakeSnapshot struct {
+	cloud.Snapshot
+	tags map[string]string
+	// pendingPolls is how many more GetSnapshotByID calls this snapshot
+	// must answer before ReadyToUse flips to true, modeling an EBS
+	// snapshot that takes a while to complete.
+	pendingPolls int
+}
+
+type fakeInstance struct {
+	nodeID string
+}
+
+// Cloud is an in-memory cloud.Provider. The zero value is not usable; create
+// one with NewCloud.
+type Cloud struct {
+	mu sync.Mutex
+
+	disks     map[string]*fakeDisk
+	snapshots map[string]*fakeSnapshot
+	instances map[string]*fakeInstance
+
+	diskSeq     int
+	snapshotSeq int
+
+	// nextSnapshotPendingPolls is consumed by the next CreateSnapshot call
+	// and then reset, see SetNextSnapshotPendingPolls.
+	nextSnapshotPendingPolls int
+}
+
+// NewCloud returns an empty fake cloud.
+func NewCloud() *Cloud {
+	return &Cloud{
+		disks:     make(map[string]*fakeDisk),
+		snapshots: make(map[string]*fakeSnapshot),
+		instances: make(map[string]*fakeInstance),
+	}
+}
+
+// InsertInstance registers nodeID as an existing EC2 instance, so
+// IsExistInstance and AttachDisk will find it. DetachDisk does not check
+// instances.
+func (c *Cloud) InsertInstance(nodeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[nodeID] = &fakeInstance{nodeID: nodeID}
+}
+
+// SetNextSnapshotPendingPolls makes the next CreateSnapshot call return a
+// snapshot that only becomes ReadyToUse after it has been polled via
+// GetSnapshotByID n times, so tests can exercise callers (like the driver's
+// clone-volume wait loop) that poll for snapshot completion.
+func (c *Cloud) SetNextSnapshotPendingPolls(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextSnapshotPendingPolls = n
+}
+
+// SetModificationCooldown makes the disk with the given volume ID behave as
+// though it was modified less than cloud.modificationCooldown ago, so tests
+// can exercise callers (like the driver's ControllerExpandVolume) that must
+// translate cloud.ErrModificationCooldown into FailedPrecondition.
+func (c *Cloud) SetModificationCooldown(volumeID string, inCooldown bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if disk, ok := c.disks[volumeID]; ok {
+		disk.inModificationCooldown = inCooldown
+	}
+}
+
+// DiskTags returns the tags of the disk with the given volume name, for use
+// in tests that assert on how CreateVolume parameters get plumbed through to
+// cloud.DiskOptions.Tags.
+func (c *Cloud) DiskTags(name string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, disk := range c.disks {
+		if disk.tags[cloud.VolumeNameTagKey] == name {
+			return disk.tags
+		}
+	}
+	return nil
+}
+
+func (c *Cloud) GetDiskByName(ctx context.Context, name string, capacityBytes int64) (*cloud.Disk, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found *fakeDisk
+	for _, disk := range c.disks {
+		if disk.tags[cloud.VolumeNameTagKey] == name {
+			if found != nil {
+				return nil, cloud.ErrMultiDisks
+			}
+			found = disk
+		}
+	}
+	if found == nil {
+		return nil, cloud.ErrNotFound
+	}
+	if found.CapacityGiB*util.GiB != capacityBytes {
+		return nil, cloud.ErrDiskExistsDiffSize
+	}
+	disk := found.Disk
+	return &disk, nil
+}
+
+func (c *Cloud) GetDiskByID(ctx context.Context, volumeID string) (*cloud.Disk, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found, ok := c.disks[volumeID]
+	if !ok {
+		return nil, cloud.ErrNotFound
+	}
+	disk := found.Disk
+	return &disk, nil
+}
+
+func (c *Cloud) CreateDisk(ctx context.Context, volumeName string, diskOptions *cloud.DiskOptions) (*cloud.Disk, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zone := diskOptions.AvailabilityZone
+	if len(zone) == 0 {
+		zone = defaultZone
+	}
+
+	c.diskSeq++
+	volumeID := fmt.Sprintf("vol-%d", c.diskSeq)
+	disk := &fakeDisk{
+		Disk: cloud.Disk{
+			VolumeID:         volumeID,
+			CapacityGiB:      util.RoundUpGiB(diskOptions.CapacityBytes),
+			AvailabilityZone: zone,
+			SnapshotID:       diskOptions.SnapshotID,
+		},
+		tags: diskOptions.Tags,
+	}
+	c.disks[volumeID] = disk
+
+	result := disk.Disk
+	return &result, nil
+}
+
+func (c *Cloud) DeleteDisk(ctx context.Context, volumeID string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.disks[volumeID]; !ok {
+		return false, cloud.ErrNotFound
+	}
+	delete(c.disks, volumeID)
+	return true, nil
+}
+
+func (c *Cloud) AttachDisk(ctx context.Context, volumeID, nodeID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.instances[nodeID]; !ok {
+		return "", fmt.Errorf("instance %q not found", nodeID)
+	}
+	disk, ok := c.disks[volumeID]
+	if !ok {
+		return "", cloud.ErrNotFound
+	}
+	if disk.attachedTo != "" && disk.attachedTo != nodeID {
+		return "", cloud.ErrAlreadyExists
+	}
+	disk.attachedTo = nodeID
+	return "/dev/xvdba", nil
+}
+
+func (c *Cloud) DetachDisk(ctx context.Context, volumeID, nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	disk, ok := c.disks[volumeID]
+	if !ok {
+		return cloud.ErrNotFound
+	}
+	disk.attachedTo = ""
+	return nil
+}
+
+func (c *Cloud) IsExistInstance(ctx context.Context, nodeID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.instances[nodeID]
+	return ok
+}
+
+func (c *Cloud) ResizeDisk(ctx context.Context, volumeID string, newSizeBytes int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	disk, ok := c.disks[volumeID]
+	if !ok {
+		return 0, cloud.ErrNotFound
+	}
+	if disk.inModificationCooldown {
+		return 0, cloud.ErrModificationCooldown
+	}
+	newSizeGiB := util.RoundUpGiB(newSizeBytes)
+	if newSizeGiB < disk.CapacityGiB {
+		return 0, cloud.ErrInvalidArgument
+	}
+	disk.CapacityGiB = newSizeGiB
+	return disk.CapacityGiB, nil
+}
+
+func (c *Cloud) ListDisks(ctx context.Context, maxEntries int, startingToken string) ([]*cloud.Disk, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	disks := make([]*cloud.Disk, 0, len(c.disks))
+	for _, disk := range c.disks {
+		d := disk.Disk
+		disks = append(disks, &d)
+	}
+	return disks, "", nil
+}
+
+func (c *Cloud) CreateSnapshot(ctx context.Context, volumeID string, snapshotOptions *cloud.SnapshotOptions) (*cloud.Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.disks[volumeID]; !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	pendingPolls := c.nextSnapshotPendingPolls
+	c.nextSnapshotPendingPolls = 0
+
+	c.snapshotSeq++
+	snapshotID := fmt.Sprintf("snap-%d", c.snapshotSeq)
+	snap := &fakeSnapshot{
+		Snapshot: cloud.Snapshot{
+			SnapshotID:     snapshotID,
+			SourceVolumeID: volumeID,
+			Size:           c.disks[volumeID].CapacityGiB * util.GiB,
+			ReadyToUse:     pendingPolls == 0,
+		},
+		tags:         snapshotOptions.Tags,
+		pendingPolls: pendingPolls,
+	}
+	c.snapshots[snapshotID] = snap
+
+	result := snap.Snapshot
+	return &result, nil
+}
+
+func (c *Cloud) DeleteSnapshot(ctx context.Context, snapshotID string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.snapshots[snapshotID]; !ok {
+		return false, cloud.ErrNotFound
+	}
+	delete(c.snapshots, snapshotID)
+	return true, nil
+}
+
+func (c *Cloud) GetSnapshotByName(ctx context.Context, name string) (*cloud.Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, snap := range c.snapshots {
+		if snap.tags[cloud.SnapshotNameTagKey] == name {
+			result := snap.Snapshot
+			return &result, nil
+		}
+	}
+	return nil, cloud.ErrNotFound
+}
+
+func (c *Cloud) GetSnapshotByID(ctx context.Context, snapshotID string) (*cloud.Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snap, ok := c.snapshots[snapshotID]
+	if !ok {
+		return nil, cloud.ErrNotFound
+	}
+	if !snap.ReadyToUse && snap.pendingPolls > 0 {
+		snap.pendingPolls--
+		if snap.pendingPolls == 0 {
+			snap.ReadyToUse = true
+		}
+	}
+	result := snap.Snapshot
+	return &result, nil
+}
+
+func (c *Cloud) ListSnapshots(ctx context.Context, sourceVolumeID string, maxEntries int, startingToken string) ([]*cloud.Snapshot, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshots := make([]*cloud.Snapshot, 0, len(c.snapshots))
+	for _, snap := range c.snapshots {
+		if sourceVolumeID != "" && snap.SourceVolumeID != sourceVolumeID {
+			continue
+		}
+		s := snap.Snapshot
+		snapshots = append(snapshots, &s)
+	}
+	return snapshots, "", nil
+}
+
+func (c *Cloud) AvailabilityZones(ctx context.Context) ([]string, error) {
+	return []string{defaultZone, "fake-az-1b"}, nil
+}
+
+var _ cloud.Provider = &Cloud{}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+const (
+	// DriverName is the canonical CSI driver name used to register the plugin.
+	DriverName = "ebs.csi.aws.com"
+
+	// TopologyKey is the topology segment key representing the availability zone.
+	TopologyKey = "topology." + DriverName + "/zone"
+
+	// FsTypeKey is the parameter/context key for the filesystem type.
+	FsTypeKey = "csi.storage.k8s.io/fstype"
+	// VolumeTypeKey is the parameter key for the EBS volume type (gp2, io1, ...).
+	VolumeTypeKey = "type"
+	// IopsPerGBKey is the parameter key for the io1 IOPS-per-GiB ratio.
+	IopsPerGBKey = "iopsPerGB"
+	// IopsKey is the parameter key for the absolute IOPS requested on gp3
+	// and io2 volumes, which aren't provisioned per-GB.
+	IopsKey = "iops"
+	// ThroughputKey is the parameter key for the throughput, in MiB/s,
+	// requested on gp3 volumes.
+	ThroughputKey = "throughput"
+	// EncryptedKey is the parameter key that enables EBS encryption.
+	EncryptedKey = "encrypted"
+	// KmsKeyIdKey is the parameter key for the customer master key used for encryption.
+	KmsKeyIdKey = "kmsKeyId"
+	// TagsKey is the parameter key for a comma-separated list of
+	// key=value pairs to apply to the created volume in addition to the
+	// driver's own tags.
+	TagsKey = "tagSpecification"
+
+	// DevicePathKey is the publish context key for the device path a volume was attached at.
+	DevicePathKey = "devicePath"
+
+	// defaultFsType is the filesystem used to format a volume when the
+	// CreateVolumeRequest/NodeStageVolumeRequest doesn't specify one.
+	defaultFsType = "ext4"
+)
@@ -18,7 +18,10 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes"
@@ -39,11 +42,23 @@ var (
 		},
 	}
 
+	// snapshotPollInterval is how often cloneVolume polls for the intermediate
+	// snapshot it creates to finish before restoring a new volume from it.
+	snapshotPollInterval = 5 * time.Second
+
+	// cloneSnapshotMaxPolls bounds how long cloneVolume waits for the
+	// intermediate snapshot to become ready before giving up, mirroring the
+	// bounded wait cloud.waitForVolumeModification uses for ModifyVolume.
+	cloneSnapshotMaxPolls = 60
+
 	// controllerCaps represents the capability of controller service
 	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	}
 )
 
@@ -54,14 +69,14 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "Volume name not provided")
 	}
 
-	var volSizeBytes int64
+	var requestedSizeBytes int64
 	capRange := req.GetCapacityRange()
 	if capRange == nil {
-		volSizeBytes = cloud.DefaultVolumeSize
+		requestedSizeBytes = cloud.DefaultVolumeSize
 	} else {
-		volSizeBytes = util.RoundUpBytes(capRange.GetRequiredBytes())
+		requestedSizeBytes = util.RoundUpBytes(capRange.GetRequiredBytes())
 		maxVolSize := capRange.GetLimitBytes()
-		if maxVolSize > 0 && maxVolSize < volSizeBytes {
+		if maxVolSize > 0 && maxVolSize < requestedSizeBytes {
 			return nil, status.Error(codes.InvalidArgument, "After round-up, volume size exceeds the limit specified")
 		}
 	}
@@ -75,6 +90,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not supported")
 	}
 
+	snapshotID, volSizeBytes, err := d.resolveVolumeContentSource(ctx, req.GetVolumeContentSource(), req.GetCapacityRange() != nil, requestedSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	disk, err := d.cloud.GetDiskByName(ctx, volName, volSizeBytes)
 	if err != nil {
 		switch err {
@@ -106,7 +126,42 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		if err != nil {
 			return nil, status.Errorf(codes.InvalidArgument, "Could not parse invalid iopsPerGB: %v", err)
 		}
+	} else if _, ok := volumeParams[IopsPerGBKey]; ok {
+		return nil, status.Errorf(codes.InvalidArgument, "iopsPerGB is only valid for volume type %q", cloud.VolumeTypeIO1)
+	}
+
+	var iops int64
+	if v, ok := volumeParams[IopsKey]; ok {
+		if volumeType != cloud.VolumeTypeGP3 && volumeType != cloud.VolumeTypeIO2 {
+			return nil, status.Errorf(codes.InvalidArgument, "iops is only valid for volume types %q and %q", cloud.VolumeTypeGP3, cloud.VolumeTypeIO2)
+		}
+		iops, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Could not parse invalid iops: %v", err)
+		}
+	}
+
+	var throughput int64
+	if v, ok := volumeParams[ThroughputKey]; ok {
+		throughput, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Could not parse invalid throughput: %v", err)
+		}
+	}
+
+	tags := make(map[string]string)
+	if v, ok := volumeParams[TagsKey]; ok {
+		parsedTags, err := parseTagSpecification(v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Could not parse invalid tagSpecification: %v", err)
+		}
+		for key, value := range parsedTags {
+			tags[key] = value
+		}
 	}
+	// The name tag is how GetDiskByName locates an existing volume on
+	// retry, so it must not be overridable by a user-supplied tag.
+	tags[cloud.VolumeNameTagKey] = volName
 
 	var (
 		isEncrypted bool
@@ -117,26 +172,29 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		kmsKeyId = volumeParams[KmsKeyIdKey]
 	}
 
+	if len(zone) == 0 && len(snapshotID) > 0 {
+		// Restoring from a snapshot is a region-wide operation, not a
+		// zonal one, so with no caller-supplied topology requirement we
+		// must still pick a concrete zone ourselves: EC2's CreateVolume
+		// rejects an empty AvailabilityZone.
+		z, err := d.pickZoneForSnapshotRestore(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not pick an availability zone to restore snapshot %q into: %v", snapshotID, err)
+		}
+		zone = z
+	}
+
 	opts := &cloud.DiskOptions{
 		CapacityBytes:    volSizeBytes,
-		Tags:             map[string]string{cloud.VolumeNameTagKey: volName},
+		Tags:             tags,
 		VolumeType:       volumeType,
 		IOPSPerGB:        iopsPerGB,
+		IOPS:             iops,
+		Throughput:       throughput,
 		AvailabilityZone: zone,
 		Encrypted:        isEncrypted,
 		KmsKeyID:         kmsKeyId,
-	}
-
-	volumeSource := req.GetVolumeContentSource()
-	if volumeSource != nil {
-		if _, ok := volumeSource.GetType().(*csi.VolumeContentSource_Snapshot); !ok {
-			return nil, status.Error(codes.InvalidArgument, "Unsupported volumeContentSource type")
-		}
-		sourceSnapshot := volumeSource.GetSnapshot()
-		if sourceSnapshot == nil {
-			return nil, status.Error(codes.InvalidArgument, "Error retrieving snapshot from the volumeContentSource")
-		}
-		opts.SnapshotID = sourceSnapshot.GetSnapshotId()
+		SnapshotID:       snapshotID,
 	}
 
 	disk, err = d.cloud.CreateDisk(ctx, volName, opts)
@@ -147,6 +205,102 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	return newCreateVolumeResponse(disk), nil
 }
 
+// resolveVolumeContentSource validates the CreateVolume request's
+// VolumeContentSource, if any, and returns the snapshot ID the new volume
+// should be restored from along with the size, in bytes, the volume must be
+// created at (bumped up to the snapshot's size when the caller omitted a
+// capacity range, or rejected with InvalidArgument when it asked for less
+// than the snapshot holds). A VolumeContentSource_Volume is implemented by
+// snapshotting the source volume and restoring from that intermediate
+// snapshot, mirroring how other CSI drivers implement volume cloning.
+func (d *Driver) resolveVolumeContentSource(ctx context.Context, volumeSource *csi.VolumeContentSource, hasSizeRange bool, requestedSizeBytes int64) (string, int64, error) {
+	if volumeSource == nil {
+		return "", requestedSizeBytes, nil
+	}
+
+	var snapshotID string
+	switch src := volumeSource.GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		sourceSnapshot := src.Snapshot
+		if sourceSnapshot == nil {
+			return "", 0, status.Error(codes.InvalidArgument, "Error retrieving snapshot from the volumeContentSource")
+		}
+		snapshotID = sourceSnapshot.GetSnapshotId()
+	case *csi.VolumeContentSource_Volume:
+		sourceVolume := src.Volume
+		if sourceVolume == nil {
+			return "", 0, status.Error(codes.InvalidArgument, "Error retrieving volume from the volumeContentSource")
+		}
+		cloned, err := d.cloneVolume(ctx, sourceVolume.GetVolumeId())
+		if err != nil {
+			return "", 0, err
+		}
+		snapshotID = cloned
+	default:
+		return "", 0, status.Error(codes.InvalidArgument, "Unsupported volumeContentSource type")
+	}
+
+	snapshot, err := d.cloud.GetSnapshotByID(ctx, snapshotID)
+	if err != nil {
+		if err == cloud.ErrNotFound {
+			return "", 0, status.Errorf(codes.NotFound, "Snapshot %q not found", snapshotID)
+		}
+		return "", 0, status.Errorf(codes.Internal, "Could not get snapshot %q: %v", snapshotID, err)
+	}
+
+	if !hasSizeRange {
+		return snapshotID, snapshot.Size, nil
+	}
+	if requestedSizeBytes < snapshot.Size {
+		return "", 0, status.Errorf(codes.InvalidArgument, "Requested size %d is smaller than source snapshot %q size %d", requestedSizeBytes, snapshotID, snapshot.Size)
+	}
+	return snapshotID, requestedSizeBytes, nil
+}
+
+// cloneVolume creates an intermediate snapshot of sourceVolumeID, or reuses
+// the one a previous, retried CreateVolume call already started, and waits
+// for it to become ready, returning its snapshot ID so the caller can
+// restore a new volume from it.
+func (d *Driver) cloneVolume(ctx context.Context, sourceVolumeID string) (string, error) {
+	if len(sourceVolumeID) == 0 {
+		return "", status.Error(codes.InvalidArgument, "Error retrieving volume id from the volumeContentSource")
+	}
+
+	snapshotName := "cloning-" + sourceVolumeID
+	snapshot, err := d.cloud.GetSnapshotByName(ctx, snapshotName)
+	if err != nil && err != cloud.ErrNotFound {
+		return "", status.Errorf(codes.Internal, "Could not look up clone snapshot %q: %v", snapshotName, err)
+	}
+
+	if snapshot == nil {
+		opts := &cloud.SnapshotOptions{
+			Tags: map[string]string{cloud.SnapshotNameTagKey: snapshotName},
+		}
+		snapshot, err = d.cloud.CreateSnapshot(ctx, sourceVolumeID, opts)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "Could not snapshot source volume %q for cloning: %v", sourceVolumeID, err)
+		}
+	}
+
+	for i := 0; !snapshot.ReadyToUse; i++ {
+		if i >= cloneSnapshotMaxPolls {
+			return "", status.Errorf(codes.DeadlineExceeded, "Timed out waiting for clone snapshot %q of volume %q to become ready", snapshot.SnapshotID, sourceVolumeID)
+		}
+		select {
+		case <-ctx.Done():
+			return "", status.FromContextError(ctx.Err()).Err()
+		case <-time.After(snapshotPollInterval):
+		}
+		polled, err := d.cloud.GetSnapshotByID(ctx, snapshot.SnapshotID)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "Could not poll snapshot %q while cloning volume %q: %v", snapshot.SnapshotID, sourceVolumeID, err)
+		}
+		snapshot = polled
+	}
+
+	return snapshot.SnapshotID, nil
+}
+
 func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	klog.V(4).Infof("DeleteVolume: called with args: %+v", *req)
 	volumeID := req.GetVolumeId()
@@ -231,6 +385,44 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	klog.V(4).Infof("ControllerExpandVolume: called with args %+v", *req)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	capRange := req.GetCapacityRange()
+	if capRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
+	}
+
+	newSize := util.RoundUpBytes(capRange.GetRequiredBytes())
+	maxVolSize := capRange.GetLimitBytes()
+	if maxVolSize > 0 && maxVolSize < newSize {
+		return nil, status.Error(codes.InvalidArgument, "After round-up, volume size exceeds the limit specified")
+	}
+
+	actualSizeGiB, err := d.cloud.ResizeDisk(ctx, volumeID, newSize)
+	if err != nil {
+		if err == cloud.ErrNotFound {
+			return nil, status.Errorf(codes.NotFound, "Volume %q not found", volumeID)
+		}
+		if err == cloud.ErrInvalidArgument {
+			return nil, status.Errorf(codes.InvalidArgument, "Could not resize volume %q: %v", volumeID, err)
+		}
+		if err == cloud.ErrModificationCooldown {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %q was modified too recently, try again later: %v", volumeID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not resize volume %q: %v", volumeID, err)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         util.GiBToBytes(actualSizeGiB),
+		NodeExpansionRequired: true,
+	}, nil
+}
+
 func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
 	var caps []*csi.ControllerServiceCapability
@@ -254,7 +446,39 @@ func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	klog.V(4).Infof("ListVolumes: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	maxEntries := int(req.GetMaxEntries())
+	if maxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Max entries request cannot be negative")
+	}
+
+	disks, nextToken, err := d.cloud.ListDisks(ctx, maxEntries, req.GetStartingToken())
+	if err != nil {
+		if err == cloud.ErrInvalidArgument {
+			return nil, status.Errorf(codes.Aborted, "Invalid starting token %q: %v", req.GetStartingToken(), err)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not list volumes: %v", err)
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(disks))
+	for _, disk := range disks {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      disk.VolumeID,
+				CapacityBytes: util.GiBToBytes(disk.CapacityGiB),
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{TopologyKey: disk.AvailabilityZone},
+					},
+				},
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -358,7 +582,63 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 }
 
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("ListSnapshots: called with args %+v", *req)
+
+	maxEntries := int(req.GetMaxEntries())
+	if maxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Max entries request cannot be negative")
+	}
+
+	snapshots, nextToken, err := d.cloud.ListSnapshots(ctx, req.GetSourceVolumeId(), maxEntries, req.GetStartingToken())
+	if err != nil {
+		if err == cloud.ErrNotFound {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if err == cloud.ErrInvalidArgument {
+			return nil, status.Errorf(codes.Aborted, "Invalid starting token %q: %v", req.GetStartingToken(), err)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not list snapshots: %v", err)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		entry, err := newListSnapshotsResponseEntry(snapshot)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not convert snapshot %q: %v", snapshot.SnapshotID, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// parseTagSpecification parses a comma-separated list of key=value pairs,
+// as accepted by the tagSpecification storage-class parameter, into a tag
+// map.
+func parseTagSpecification(tagSpecification string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(tagSpecification, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag pair %q, expected key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// pickZoneForSnapshotRestore picks an availability zone in the snapshot's
+// (i.e. the driver's own) region to restore a snapshot-sourced volume into
+// when the CSI request carried no topology requirement.
+func (d *Driver) pickZoneForSnapshotRestore(ctx context.Context) (string, error) {
+	zones, err := d.cloud.AvailabilityZones(ctx)
+	if err != nil {
+		return "", err
+	}
+	return zones[0], nil
 }
 
 // pickAvailabilityZone selects 1 zone given topology requirement.
@@ -399,6 +679,22 @@ func newCreateVolumeResponse(disk *cloud.Disk) *csi.CreateVolumeResponse {
 	}
 }
 
+func newListSnapshotsResponseEntry(snapshot *cloud.Snapshot) (*csi.ListSnapshotsResponse_Entry, error) {
+	ts, err := ptypes.TimestampProto(snapshot.CreationTime)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snapshot.SnapshotID,
+			SourceVolumeId: snapshot.SourceVolumeID,
+			SizeBytes:      snapshot.Size,
+			CreationTime:   ts,
+			ReadyToUse:     snapshot.ReadyToUse,
+		},
+	}, nil
+}
+
 func newCreateSnapshotResponse(snapshot *cloud.Snapshot) (*csi.CreateSnapshotResponse, error) {
 	ts, err := ptypes.TimestampProto(snapshot.CreationTime)
 	if err != nil {
@@ -0,0 +1,370 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/cloud"
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/cloud/fake"
+)
+
+func newTestDriver() *Driver {
+	return &Driver{
+		cloud: fake.NewCloud(),
+	}
+}
+
+func TestCreateVolumeIsIdempotent(t *testing.T) {
+	d := newTestDriver()
+	req := &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	}
+
+	first, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	second, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("second CreateVolume failed: %v", err)
+	}
+	if first.Volume.VolumeId != second.Volume.VolumeId {
+		t.Errorf("expected CreateVolume to be idempotent, got %q then %q", first.Volume.VolumeId, second.Volume.VolumeId)
+	}
+}
+
+func TestCreateVolumeExistsDifferentSize(t *testing.T) {
+	d := newTestDriver()
+	volCaps := []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}}
+
+	if _, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: volCaps,
+	}); err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024 * 1024},
+		VolumeCapabilities: volCaps,
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+}
+
+func TestDeleteVolumeNotFoundIsSuccess(t *testing.T) {
+	d := newTestDriver()
+	resp, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-does-not-exist"})
+	if err != nil {
+		t.Fatalf("expected DeleteVolume of a missing volume to succeed, got %v", err)
+	}
+	if resp == nil {
+		t.Error("expected a non-nil response")
+	}
+}
+
+func TestControllerPublishAndUnpublishVolume(t *testing.T) {
+	d := newTestDriver()
+	c := d.cloud.(*fake.Cloud)
+	c.InsertInstance("i-test")
+
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	volumeID := createResp.Volume.VolumeId
+
+	publishResp, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "i-test",
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCaps[0]},
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if publishResp.PublishContext[DevicePathKey] == "" {
+		t.Error("expected a device path in the publish context")
+	}
+
+	if _, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   "i-test",
+	}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume failed: %v", err)
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	d := newTestDriver()
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	expandResp, err := d.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      createResp.Volume.VolumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume failed: %v", err)
+	}
+	if expandResp.CapacityBytes != 10*1024*1024*1024 {
+		t.Errorf("expected 10GiB, got %d bytes", expandResp.CapacityBytes)
+	}
+	if !expandResp.NodeExpansionRequired {
+		t.Error("expected NodeExpansionRequired to be true")
+	}
+}
+
+func TestControllerExpandVolumeDuringModificationCooldown(t *testing.T) {
+	d := newTestDriver()
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	c := d.cloud.(*fake.Cloud)
+	c.SetModificationCooldown(createResp.Volume.VolumeId, true)
+
+	_, err = d.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      createResp.Volume.VolumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024 * 1024},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+}
+
+func TestCreateSnapshotAndRestore(t *testing.T) {
+	d := newTestDriver()
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-source",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	snapResp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-test",
+		SourceVolumeId: createResp.Volume.VolumeId,
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	restoreResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-restored",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapResp.Snapshot.SnapshotId},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume from snapshot failed: %v", err)
+	}
+	if restoreResp.Volume.CapacityBytes != 5*1024*1024*1024 {
+		t.Errorf("expected restored volume to inherit the snapshot size, got %d bytes", restoreResp.Volume.CapacityBytes)
+	}
+}
+
+func TestCreateVolumeFromSnapshotWithNoTopologyRequirementPicksAZone(t *testing.T) {
+	d := newTestDriver()
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-source",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	snapResp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-test",
+		SourceVolumeId: createResp.Volume.VolumeId,
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	// No AccessibilityRequirements at all: the driver must still pick a
+	// zone itself rather than handing EC2 an empty AvailabilityZone.
+	restoreResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-restored",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapResp.Snapshot.SnapshotId},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume from snapshot failed: %v", err)
+	}
+
+	topology := restoreResp.Volume.AccessibleTopology
+	if len(topology) != 1 || topology[0].Segments[TopologyKey] == "" {
+		t.Errorf("expected a non-empty AccessibleTopology zone, got %+v", topology)
+	}
+}
+
+func TestCreateVolumeWithTagSpecification(t *testing.T) {
+	d := newTestDriver()
+	c := d.cloud.(*fake.Cloud)
+
+	if _, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		Parameters:         map[string]string{TagsKey: "team=storage,env=prod"},
+	}); err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	tags := c.DiskTags("vol-test")
+	if tags["team"] != "storage" || tags["env"] != "prod" {
+		t.Errorf("expected custom tags to be merged, got %+v", tags)
+	}
+	if tags[cloud.VolumeNameTagKey] != "vol-test" {
+		t.Errorf("expected the default name tag to still be set, got %+v", tags)
+	}
+}
+
+func TestCreateVolumeRejectsIopsPerGBForNonIO1(t *testing.T) {
+	d := newTestDriver()
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		Parameters:         map[string]string{VolumeTypeKey: cloud.VolumeTypeGP3, IopsPerGBKey: "50"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestCreateVolumeRejectsIopsForUnsupportedVolumeType(t *testing.T) {
+	d := newTestDriver()
+	_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		Parameters:         map[string]string{VolumeTypeKey: cloud.VolumeTypeGP2, IopsKey: "3000"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestCreateVolumeFromClonedVolumeWaitsForSnapshot(t *testing.T) {
+	oldInterval := snapshotPollInterval
+	snapshotPollInterval = time.Millisecond
+	defer func() { snapshotPollInterval = oldInterval }()
+
+	d := newTestDriver()
+	c := d.cloud.(*fake.Cloud)
+
+	sourceResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-source",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	c.SetNextSnapshotPendingPolls(2)
+
+	cloneResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-clone",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceResp.Volume.VolumeId},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume from cloned volume failed: %v", err)
+	}
+	if cloneResp.Volume.CapacityBytes != 5*1024*1024*1024 {
+		t.Errorf("expected cloned volume to inherit the source volume's size, got %d bytes", cloneResp.Volume.CapacityBytes)
+	}
+}
+
+func TestListVolumesAndSnapshots(t *testing.T) {
+	d := newTestDriver()
+	createResp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &volumeCaps[0]}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	listResp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(listResp.Entries) != 1 || listResp.Entries[0].Volume.VolumeId != createResp.Volume.VolumeId {
+		t.Errorf("expected ListVolumes to return the created volume, got %+v", listResp.Entries)
+	}
+
+	if _, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-test",
+		SourceVolumeId: createResp.Volume.VolumeId,
+	}); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	snapListResp, err := d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: createResp.Volume.VolumeId})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(snapListResp.Entries) != 1 {
+		t.Errorf("expected ListSnapshots to return one snapshot, got %d", len(snapListResp.Entries))
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	"github.com/kubernetes-sigs/aws-ebs-csi-driver/pkg/cloud"
+)
+
+// Mode selects which CSI services a Driver serves. Splitting the controller
+// and node services into their own binaries lets the controller Deployment
+// carry only AWS IAM credentials and the node DaemonSet carry only mount
+// tooling, instead of every pod shipping both dependency sets.
+type Mode string
+
+const (
+	// ControllerMode serves only the identity and controller services.
+	ControllerMode Mode = "controller"
+	// NodeMode serves only the identity and node services.
+	NodeMode Mode = "node"
+	// AllMode serves the identity, controller and node services from a
+	// single process, preserving the original all-in-one deployment.
+	AllMode Mode = "all"
+)
+
+// Driver implements the CSI identity, controller and node services for EBS.
+// Which services are actually registered in Run is controlled by mode.
+type Driver struct {
+	endpoint string
+	mode     Mode
+	srv      *grpc.Server
+
+	cloud   cloud.Provider
+	mounter Mounter
+}
+
+// NewDriver creates a Driver serving the given mode, ready to be Run. cloud
+// credentials are only required, and only looked up, for ControllerMode and
+// AllMode; NodeMode never talks to the EC2 API.
+func NewDriver(endpoint, region string, mode Mode) (*Driver, error) {
+	switch mode {
+	case ControllerMode, NodeMode, AllMode:
+	default:
+		return nil, fmt.Errorf("invalid mode %q: must be one of %q, %q, %q", mode, ControllerMode, NodeMode, AllMode)
+	}
+
+	d := &Driver{
+		endpoint: endpoint,
+		mode:     mode,
+	}
+
+	if mode == ControllerMode || mode == AllMode {
+		c, err := cloud.NewCloud(region)
+		if err != nil {
+			return nil, fmt.Errorf("could not create cloud: %v", err)
+		}
+		d.cloud = c
+	}
+
+	if mode == NodeMode || mode == AllMode {
+		d.mounter = newNodeMounter()
+	}
+
+	return d, nil
+}
+
+// Run starts the gRPC server and blocks until it stops serving.
+func (d *Driver) Run() error {
+	scheme, addr, err := parseEndpoint(d.endpoint)
+	if err != nil {
+		return err
+	}
+
+	if scheme == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove %s: %v", addr, err)
+		}
+	}
+
+	listener, err := net.Listen(scheme, addr)
+	if err != nil {
+		return err
+	}
+
+	d.srv = grpc.NewServer()
+	csi.RegisterIdentityServer(d.srv, d)
+	if d.mode == ControllerMode || d.mode == AllMode {
+		csi.RegisterControllerServer(d.srv, d)
+	}
+	if d.mode == NodeMode || d.mode == AllMode {
+		csi.RegisterNodeServer(d.srv, d)
+	}
+
+	return d.srv.Serve(listener)
+}
+
+// Stop stops the gRPC server.
+func (d *Driver) Stop() {
+	d.srv.Stop()
+}
+
+func parseEndpoint(endpoint string) (string, string, error) {
+	segments := strings.SplitN(endpoint, "://", 2)
+	if len(segments) != 2 {
+		return "", "", fmt.Errorf("invalid endpoint: %v", endpoint)
+	}
+
+	scheme := strings.ToLower(segments[0])
+	switch scheme {
+	case "tcp", "unix":
+		return scheme, segments[1], nil
+	default:
+		return "", "", fmt.Errorf("unsupported scheme: %s", segments[0])
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Mounter is the interface the node service uses to format, mount and resize
+// block devices. It is implemented by nodeMounter.
+type Mounter interface {
+	mount.Interface
+	FormatAndMount(source, target, fstype string, options []string) error
+	GetDeviceName(mountPath string) (string, int, error)
+	IsCorruptedMnt(err error) bool
+	MakeDir(path string) error
+	MakeFile(path string) error
+	PathExists(path string) (bool, error)
+	Resize(devicePath, deviceMountPath string) (bool, error)
+}
+
+// nodeMounter implements Mounter using the real host mount and filesystem
+// tooling. It is only usable on Linux nodes.
+type nodeMounter struct {
+	mount.SafeFormatAndMount
+}
+
+func newNodeMounter() Mounter {
+	return &nodeMounter{
+		mount.SafeFormatAndMount{
+			Interface: mount.New(""),
+			Exec:      mount.NewOsExec(),
+		},
+	}
+}
+
+// GetDeviceName returns the device mounted at mountPath, and how many times
+// it is mounted there, by walking the host's mount table.
+func (m *nodeMounter) GetDeviceName(mountPath string) (string, int, error) {
+	mountPoints, err := m.List()
+	if err != nil {
+		return "", 0, err
+	}
+
+	device := ""
+	refCount := 0
+	for _, mp := range mountPoints {
+		if mp.Path == mountPath {
+			device = mp.Device
+			refCount++
+		}
+	}
+	return device, refCount, nil
+}
+
+// IsCorruptedMnt reports whether err indicates a mount point whose backing
+// device has gone away, which surfaces as one of a small set of syscall
+// errors rather than a normal I/O failure.
+func (m *nodeMounter) IsCorruptedMnt(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var underlyingError error
+	switch pe := err.(type) {
+	case *os.PathError:
+		underlyingError = pe.Err
+	case *os.LinkError:
+		underlyingError = pe.Err
+	case *os.SyscallError:
+		underlyingError = pe.Err
+	default:
+		underlyingError = err
+	}
+
+	return underlyingError == syscall.ENOTCONN || underlyingError == syscall.ESTALE ||
+		underlyingError == syscall.EIO || underlyingError == syscall.EACCES
+}
+
+// MakeDir creates path, along with any necessary parents, succeeding if it
+// already exists.
+func (m *nodeMounter) MakeDir(path string) error {
+	if err := os.MkdirAll(path, os.FileMode(0755)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MakeFile creates an empty file at path, succeeding if it already exists.
+// It is used to create the bind-mount target for block-mode volumes, which
+// must be a file rather than a directory.
+func (m *nodeMounter) MakeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE, os.FileMode(0644))
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
+
+// PathExists reports whether path exists.
+func (m *nodeMounter) PathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Resize grows the filesystem at deviceMountPath to fill devicePath, using
+// the resize tool appropriate to the filesystem already on the device.
+func (m *nodeMounter) Resize(devicePath, deviceMountPath string) (bool, error) {
+	fsType, err := getDiskFormat(devicePath)
+	if err != nil {
+		return false, fmt.Errorf("could not determine filesystem type of %q: %v", devicePath, err)
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		out, err := exec.Command("resize2fs", devicePath).CombinedOutput()
+		if err != nil {
+			return false, fmt.Errorf("resize2fs failed: %v, output: %s", err, out)
+		}
+	case "xfs":
+		out, err := exec.Command("xfs_growfs", deviceMountPath).CombinedOutput()
+		if err != nil {
+			return false, fmt.Errorf("xfs_growfs failed: %v, output: %s", err, out)
+		}
+	default:
+		return false, fmt.Errorf("resize is not supported for filesystem type %q", fsType)
+	}
+	return true, nil
+}
+
+// getDiskFormat returns the filesystem type already present on devicePath,
+// or "" if the device isn't formatted.
+func getDiskFormat(devicePath string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", devicePath).CombinedOutput()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid failed: %v, output: %s", err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
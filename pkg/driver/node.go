@@ -0,0 +1,384 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var (
+	// nodeCaps represents the capability of node service.
+	nodeCaps = []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	}
+)
+
+// NodeStageVolume formats the attached device, if it isn't already, and
+// mounts it at the staging path so NodePublishVolume can bind-mount it into
+// as many pods as the access mode allows. Block-mode volumes skip formatting
+// entirely: the staging path is bind-mounted directly to the raw device.
+func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	klog.V(4).Infof("NodeStageVolume: called with args %+v", *req)
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	target := req.GetStagingTargetPath()
+	if len(target) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+
+	devicePath, ok := req.GetPublishContext()[DevicePathKey]
+	if !ok || len(devicePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Device path not provided")
+	}
+
+	if volCap.GetBlock() != nil {
+		device, refCount, err := d.mounter.GetDeviceName(target)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not check if %q is already staged: %v", target, err)
+		}
+		if refCount > 0 {
+			if device != devicePath {
+				return nil, status.Errorf(codes.AlreadyExists, "Staging target %q is already staged with a different device", target)
+			}
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+		if err := d.mounter.MakeFile(target); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not create staging target file %q: %v", target, err)
+		}
+		if err := d.mounter.Mount(devicePath, target, "", []string{"bind"}); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not bind mount %q to %q: %v", devicePath, target, err)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mountVol := volCap.GetMount()
+	if mountVol == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability has neither block nor mount access type")
+	}
+	fsType := mountVol.GetFsType()
+	if len(fsType) == 0 {
+		fsType = defaultFsType
+	}
+
+	if err := d.mounter.MakeDir(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create staging target directory %q: %v", target, err)
+	}
+
+	device, refCount, err := d.mounter.GetDeviceName(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if %q is already staged: %v", target, err)
+	}
+	if refCount > 0 {
+		if device != devicePath {
+			return nil, status.Errorf(codes.AlreadyExists, "Staging target %q is already staged with a different device", target)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := d.mounter.FormatAndMount(devicePath, target, fsType, mountVol.GetMountFlags()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not format %q and mount it at %q: %v", devicePath, target, err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the staging path NodeStageVolume prepared.
+func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	klog.V(4).Infof("NodeUnstageVolume: called with args %+v", *req)
+
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	target := req.GetStagingTargetPath()
+	if len(target) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
+	}
+
+	exists, err := d.mounter.PathExists(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if staging target %q exists: %v", target, err)
+	}
+	if !exists {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	if err := d.mounter.Unmount(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not unmount staging target %q: %v", target, err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind-mounts the staged device (or, for block volumes,
+// the raw device itself) from the staging path into the pod's target path.
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	klog.V(4).Infof("NodePublishVolume: called with args %+v", *req)
+
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	target := req.GetTargetPath()
+	if len(target) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+
+	source := req.GetStagingTargetPath()
+	blockVolume := volCap.GetBlock() != nil
+	if blockVolume {
+		devicePath, ok := req.GetPublishContext()[DevicePathKey]
+		if !ok || len(devicePath) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Device path not provided")
+		}
+		source = devicePath
+		if err := d.mounter.MakeFile(target); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not create publish target file %q: %v", target, err)
+		}
+	} else {
+		if len(source) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
+		}
+		if err := d.mounter.MakeDir(target); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not create publish target directory %q: %v", target, err)
+		}
+	}
+
+	_, refCount, err := d.mounter.GetDeviceName(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if %q is already published: %v", target, err)
+	}
+	if refCount > 0 {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if mountVol := volCap.GetMount(); mountVol != nil {
+		options = append(options, mountVol.GetMountFlags()...)
+	}
+
+	if err := d.mounter.Mount(source, target, "", options); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not bind mount %q to %q: %v", source, target, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts the pod's target path.
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	klog.V(4).Infof("NodeUnpublishVolume: called with args %+v", *req)
+
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	target := req.GetTargetPath()
+	if len(target) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
+	}
+
+	exists, err := d.mounter.PathExists(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if target %q exists: %v", target, err)
+	}
+	if !exists {
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	if err := d.mounter.Unmount(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not unmount target %q: %v", target, err)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats reports the filesystem capacity at volumePath by
+// statfs-ing it directly, without going through the EC2 API.
+func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	klog.V(4).Infof("NodeGetVolumeStats: called with args %+v", *req)
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	exists, err := d.mounter.PathExists(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check if volume path %q exists: %v", volumePath, err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "Volume path %q does not exist", volumePath)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &stat); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not get stats for %q: %v", volumePath, err)
+	}
+
+	blockSize := int64(stat.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(stat.Blocks) * blockSize,
+				Available: int64(stat.Bavail) * blockSize,
+				Used:      int64(stat.Blocks-stat.Bfree) * blockSize,
+			},
+		},
+	}, nil
+}
+
+// NodeGetInfo returns the node's identity: its EC2 instance ID, which is the
+// node ID ControllerPublishVolume attaches volumes to. The ID is read from
+// the EC2 instance metadata service, which needs no AWS credentials, so this
+// works in NodeMode too, where the driver has no cloud.Provider.
+func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	klog.V(4).Infof("NodeGetInfo: called with args %+v", *req)
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create metadata session: %v", err)
+	}
+	nodeID, err := ec2metadata.New(sess).GetMetadata("instance-id")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine node ID: %v", err)
+	}
+
+	return &csi.NodeGetInfoResponse{
+		NodeId: nodeID,
+	}, nil
+}
+
+func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	klog.V(4).Infof("NodeGetCapabilities: called with args %+v", *req)
+	var caps []*csi.NodeServiceCapability
+	for _, cap := range nodeCaps {
+		c := &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: cap,
+				},
+			},
+		}
+		caps = append(caps, c)
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// NodeExpandVolume grows the filesystem on an already-published volume to
+// match the new size ControllerExpandVolume reported. It re-reads the block
+// device so the kernel picks up the larger backing disk, grows the partition
+// table when the device is partitioned, and runs the filesystem-specific
+// resize tool.
+func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	klog.V(4).Infof("NodeExpandVolume: called with args %+v", *req)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	devicePath, _, err := d.mounter.GetDeviceName(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine device path for %q: %v", volumePath, err)
+	}
+	if len(devicePath) == 0 {
+		return nil, status.Errorf(codes.NotFound, "Could not find device path for volume %q mounted at %q", volumeID, volumePath)
+	}
+
+	if err := rescanBlockDevice(devicePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not rescan device %q: %v", devicePath, err)
+	}
+
+	if err := growPartitionIfPresent(devicePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not grow partition on %q: %v", devicePath, err)
+	}
+
+	if _, err := d.mounter.Resize(devicePath, volumePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not resize filesystem on %q: %v", devicePath, err)
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+	}, nil
+}
+
+// rescanBlockDevice asks the kernel to re-read the size of devicePath so a
+// ModifyVolume that grew the backing EBS volume is visible to the node
+// without a reboot.
+func rescanBlockDevice(devicePath string) error {
+	rescanPath := fmt.Sprintf("/sys/class/block/%s/device/rescan", filepath.Base(devicePath))
+	if err := os.WriteFile(rescanPath, []byte("1"), 0666); err != nil {
+		return fmt.Errorf("rescan failed: %v", err)
+	}
+	return nil
+}
+
+// growPartitionIfPresent grows the first partition on devicePath, if the
+// device is partitioned (NVMe volumes used on newer instance types attach
+// as a partitioned disk, older Xen volumes do not).
+func growPartitionIfPresent(devicePath string) error {
+	out, err := exec.Command("growpart", devicePath, "1").CombinedOutput()
+	if err != nil {
+		if isNoPartitionError(out) {
+			return nil
+		}
+		return fmt.Errorf("growpart failed: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func isNoPartitionError(output []byte) bool {
+	msg := string(output)
+	return strings.Contains(msg, "NOCHANGE") || strings.Contains(msg, "not a partitioned device")
+}